@@ -0,0 +1,93 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Deployment describes a job that runs in reaction to a deployment_status
+// webhook event (and optionally on a periodic timer), the deployment-kind
+// counterpart to Presubmit/Postsubmit.
+type Deployment struct {
+	// Name is the job's name.
+	Name string `json:"name"`
+
+	// Environment is the deployment environment this job reacts to, e.g.
+	// "staging" or "production".
+	Environment string `json:"environment"`
+	// State is the deployment_status state this job reacts to: "success",
+	// "failure" or "pending".
+	State string `json:"state,omitempty"`
+
+	// Cron and Interval optionally schedule this job to also run on a
+	// timer, independent of any deployment_status event, mirroring
+	// Periodic. At most one of the two should be set.
+	Cron     string `json:"cron,omitempty"`
+	Interval string `json:"interval,omitempty"`
+
+	// RunIfChanged and SkipIfOnlyChanged scope this job to deployments
+	// whose diff (the deployed SHA against its parent) does, or does not
+	// solely, touch the given regexp. At most one of the two should be
+	// set, mirroring Presubmit's run_if_changed/skip_if_only_changed.
+	RunIfChanged      string `json:"run_if_changed,omitempty"`
+	SkipIfOnlyChanged string `json:"skip_if_only_changed,omitempty"`
+}
+
+// ShouldRun reports whether this deployment job should run given changes,
+// the diff between the deployed SHA and its parent. If forced is true it
+// always runs. Otherwise, if neither RunIfChanged nor SkipIfOnlyChanged is
+// set, defaultBehavior is returned unchanged; if one is set, changes is
+// consulted to decide.
+func (d Deployment) ShouldRun(changes ChangedFilesProvider, forced, defaultBehavior bool) (bool, error) {
+	if forced {
+		return true, nil
+	}
+	if d.RunIfChanged == "" && d.SkipIfOnlyChanged == "" {
+		return defaultBehavior, nil
+	}
+
+	changedFiles, err := changes()
+	if err != nil {
+		return false, fmt.Errorf("%s: error getting changed files: %w", d.Name, err)
+	}
+
+	if d.RunIfChanged != "" {
+		re, err := regexp.Compile(d.RunIfChanged)
+		if err != nil {
+			return false, fmt.Errorf("%s: invalid run_if_changed regexp: %w", d.Name, err)
+		}
+		for _, f := range changedFiles {
+			if re.MatchString(f) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	re, err := regexp.Compile(d.SkipIfOnlyChanged)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid skip_if_only_changed regexp: %w", d.Name, err)
+	}
+	for _, f := range changedFiles {
+		if !re.MatchString(f) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pjutil
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+// ErrChangedFilesTruncated is the sentinel error a config.ChangedFilesProvider
+// should wrap when it knows its result is incomplete, e.g. because GitHub's
+// pushed/PR files APIs cap their response at 3000 entries. FilterPresubmits
+// and AvailablePresubmits use it as the signal to recompute the diff via git
+// instead of silently trusting a partial file list.
+var ErrChangedFilesTruncated = errors.New("changed files list was truncated")
+
+// GitDiffClient is the minimal git capability FilterPresubmits needs to
+// recover from a truncated ChangedFilesProvider: a full, untruncated list of
+// the paths that differ between two revisions.
+type GitDiffClient interface {
+	Diff(base, head string) ([]string, error)
+}
+
+// GitClientFactory vends a GitDiffClient for a given org/repo. It is
+// satisfied by k8s.io/test-infra/prow/git/v2.ClientFactory wrapped to expose
+// Diff. A nil GitClientFactory is valid: callers that can't provide one keep
+// today's behavior of trusting whatever the provider returned.
+type GitClientFactory func(org, repo string) (GitDiffClient, error)
+
+// GitDiffCache memoizes git-computed diffs for the lifetime of a single
+// AvailablePresubmits/FilterPresubmits call (or a handful of them sharing
+// one cache), so that recovering from a truncated provider costs one git
+// invocation per (org, repo, base, head) no matter how many presubmits are
+// being filtered. A nil *GitDiffCache is valid and simply never falls back.
+type GitDiffCache struct {
+	factory GitClientFactory
+	cached  map[diffCacheKey][]string
+}
+
+type diffCacheKey struct {
+	org, repo, base, head string
+}
+
+// NewGitDiffCache builds a GitDiffCache backed by factory. factory may be
+// nil, in which case the cache never falls back: withTruncationFallback
+// keeps today's behavior of trusting whatever partial list the provider
+// returned instead of erroring.
+func NewGitDiffCache(factory GitClientFactory) *GitDiffCache {
+	return &GitDiffCache{factory: factory, cached: map[diffCacheKey][]string{}}
+}
+
+func (d *GitDiffCache) diff(org, repo, base, head string) ([]string, error) {
+	key := diffCacheKey{org: org, repo: repo, base: base, head: head}
+	if changes, ok := d.cached[key]; ok {
+		return changes, nil
+	}
+	client, err := d.factory(org, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get git client for %s/%s: %w", org, repo, err)
+	}
+	changes, err := client.Diff(base, head)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s...%s for %s/%s: %w", base, head, org, repo, err)
+	}
+	d.cached[key] = changes
+	return changes, nil
+}
+
+// withTruncationFallback wraps changes so that, if it ever reports
+// ErrChangedFilesTruncated, the returned provider instead serves the diff
+// git computes between base and head. It is nil-safe: with a nil cache or a
+// cache with no factory, truncation is logged and the partial list the
+// provider returned is trusted as-is.
+func withTruncationFallback(changes config.ChangedFilesProvider, org, repo, base, head string, cache *GitDiffCache, logger logrus.FieldLogger) config.ChangedFilesProvider {
+	if changes == nil {
+		return nil
+	}
+	return func() ([]string, error) {
+		files, err := changes()
+		if err == nil || !errors.Is(err, ErrChangedFilesTruncated) {
+			return files, err
+		}
+		if cache == nil || cache.factory == nil {
+			logger.WithFields(logrus.Fields{"org": org, "repo": repo, "base": base, "head": head}).
+				Warning("Changed files list was truncated and no git client factory was configured; trusting the partial list.")
+			return files, nil
+		}
+		logger.WithFields(logrus.Fields{"org": org, "repo": repo, "base": base, "head": head}).
+			Info("Changed files list was truncated, falling back to git diff.")
+		return cache.diff(org, repo, base, head)
+	}
+}
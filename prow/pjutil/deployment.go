@@ -0,0 +1,193 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pjutil
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/test-infra/prow/config"
+)
+
+// DeploymentFilterFunc digests a deployment config to determine if:
+//  - the deployment matched the filter
+//  - we know that the deployment is forced to run
+//  - what the default behavior should be if the deployment runs
+//    conditionally and does not match its run_if_changed conditions
+//
+// It mirrors Filter, but is keyed off config.Deployment instead of
+// config.Presubmit, since deployment jobs are triggered by deployment_status
+// events (and optionally a timer) rather than comments or pushes.
+type DeploymentFilterFunc func(d config.Deployment) (shouldRun bool, forcedToRun bool, defaultBehavior bool)
+
+// NamedDeploymentFilter pairs a DeploymentFilterFunc with a short
+// identifier, mirroring NamedFilter, so FilterDeployments/
+// AvailableDeployments can report decisions through the same
+// pjutil_filter_decisions_total/pjutil_filter_duration_seconds metrics
+// FilterPresubmits uses.
+type NamedDeploymentFilter struct {
+	DeploymentFilterFunc
+	name string
+}
+
+// Name returns the identifier this filter was constructed with.
+func (nf NamedDeploymentFilter) Name() string {
+	return nf.name
+}
+
+func namedDeploymentFilter(name string, f DeploymentFilterFunc) NamedDeploymentFilter {
+	return NamedDeploymentFilter{DeploymentFilterFunc: f, name: name}
+}
+
+// DeploymentFilter builds a filter that matches deployment jobs configured
+// for env whose desired state equals the incoming deployment_status event's
+// state, e.g. env="staging", state="success" triggers jobs configured to
+// run smoke tests whenever staging transitions to success. Matching is not
+// forced: a job with RunIfChanged/SkipIfOnlyChanged set still only runs if
+// the diff between the deployed SHA and its parent satisfies it, same as
+// TestAllFilter leaves run_if_changed in effect for automatically-triggered
+// presubmits. Jobs with neither set always run once env/state match.
+func DeploymentFilter(env, state string) NamedDeploymentFilter {
+	return namedDeploymentFilter("deployment-"+state, func(d config.Deployment) (bool, bool, bool) {
+		matches := d.Environment == env && d.State == state
+		return matches, false, true
+	})
+}
+
+// PeriodicDeploymentFilter builds a filter for deployment jobs that declare
+// a periodic re-run interval rather than (or in addition to) reacting to
+// deployment_status events. It matches every periodic deployment job
+// unconditionally, forced to run; scheduling when the timer fires is the
+// caller's responsibility, same as periodic presubmits.
+func PeriodicDeploymentFilter() NamedDeploymentFilter {
+	return namedDeploymentFilter("periodic-deployment", func(d config.Deployment) (bool, bool, bool) {
+		return d.Cron != "" || d.Interval != "", true, true
+	})
+}
+
+// FilterDeployments determines which deployments should run by evaluating
+// the user-provided filter, falling back to a recomputed git diff the same
+// way FilterPresubmits does when changes reports ErrChangedFilesTruncated.
+// base here is the deployed SHA's parent and head is the deployed SHA, since
+// that is the diff run_if_changed evaluates deployment jobs against.
+//
+// Decisions and duration are recorded through the same
+// pjutil_filter_decisions_total/pjutil_filter_duration_seconds metrics
+// FilterPresubmits uses; since deployments have no branch, env fills that
+// label instead.
+func FilterDeployments(filter NamedDeploymentFilter, changes config.ChangedFilesProvider, org, repo, env, base, head string, deployments []config.Deployment, cache *GitDiffCache, logger logrus.FieldLogger) ([]config.Deployment, error) {
+	defer observeFilterDuration(filter.Name(), time.Now())
+	changes = withTruncationFallback(changes, org, repo, base, head, cache, logger)
+
+	var toTrigger []config.Deployment
+	var namesToTrigger []string
+	var noMatch, shouldnotRun int
+	for _, deployment := range deployments {
+		matches, forced, defaults := filter.DeploymentFilterFunc(deployment)
+		if !matches {
+			noMatch++
+			recordFilterDecision(filter.Name(), org, repo, env, decisionNoMatch)
+			continue
+		}
+		shouldRun, err := deployment.ShouldRun(changes, forced, defaults)
+		if err != nil {
+			recordFilterDecision(filter.Name(), org, repo, env, decisionError)
+			return nil, fmt.Errorf("%s: should run: %w", deployment.Name, err)
+		}
+		if !shouldRun {
+			shouldnotRun++
+			recordFilterDecision(filter.Name(), org, repo, env, decisionShouldNotRun)
+			continue
+		}
+		recordFilterDecision(filter.Name(), org, repo, env, decisionTriggered)
+		toTrigger = append(toTrigger, deployment)
+		namesToTrigger = append(namesToTrigger, deployment.Name)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"to-trigger":           namesToTrigger,
+		"total-count":          len(deployments),
+		"to-trigger-count":     len(toTrigger),
+		"no-match-count":       noMatch,
+		"should-not-run-count": shouldnotRun}).Debug("Filtered complete.")
+	return toTrigger, nil
+}
+
+// AvailableDeployments returns the set of deployment job names that would
+// run for env transitioning to each of the known deployment states, mirroring
+// AvailablePresubmits for the comment-driven presubmit commands.
+func AvailableDeployments(changes config.ChangedFilesProvider, org, repo, env, base, head string,
+	deployments []config.Deployment, gitClient GitClientFactory, logger *logrus.Entry) (sets.String, sets.String, sets.String, error) {
+	success := sets.NewString()
+	failure := sets.NewString()
+	pending := sets.NewString()
+	cache := NewGitDiffCache(gitClient)
+
+	runOnSuccess, err := FilterDeployments(DeploymentFilter(env, "success"), changes, org, repo, env, base, head, deployments, cache, logger)
+	if err != nil {
+		return success, failure, pending, err
+	}
+	runOnFailure, err := FilterDeployments(DeploymentFilter(env, "failure"), changes, org, repo, env, base, head, deployments, cache, logger)
+	if err != nil {
+		return success, failure, pending, err
+	}
+	runOnPending, err := FilterDeployments(DeploymentFilter(env, "pending"), changes, org, repo, env, base, head, deployments, cache, logger)
+	if err != nil {
+		return success, failure, pending, err
+	}
+
+	for _, d := range runOnSuccess {
+		success.Insert(d.Name)
+	}
+	for _, d := range runOnFailure {
+		failure.Insert(d.Name)
+	}
+	for _, d := range runOnPending {
+		pending.Insert(d.Name)
+	}
+
+	return success, failure, pending, nil
+}
+
+// DeploymentStatusEvent is the subset of a GitHub deployment_status webhook
+// payload needed to decide which deployment jobs to trigger. hook's event
+// dispatcher decodes the full webhook and passes this down, the same way it
+// turns an issue_comment payload into the body string PresubmitFilter takes.
+type DeploymentStatusEvent struct {
+	Org, Repo string
+	// SHA is the commit the deployment points at; ParentSHA is its parent,
+	// together forming the diff run_if_changed deployment jobs evaluate
+	// against.
+	SHA, ParentSHA string
+	Environment    string
+	State          string
+}
+
+// TriggerDeployments is the hook-facing entry point for a deployment_status
+// webhook: it filters deployments configured for the event's environment and
+// state and returns the ones that should run, falling back through
+// gitClient to a real git diff between the deployed SHA and its parent if
+// changes is truncated. hook's deployment_status handler calls this the
+// same way its issue_comment handler calls PresubmitFilter/FilterPresubmits
+// for `/test` commands.
+func TriggerDeployments(de DeploymentStatusEvent, changes config.ChangedFilesProvider, deployments []config.Deployment, gitClient GitClientFactory, logger *logrus.Entry) ([]config.Deployment, error) {
+	filter := DeploymentFilter(de.Environment, de.State)
+	return FilterDeployments(filter, changes, de.Org, de.Repo, de.Environment, de.ParentSHA, de.SHA, deployments, NewGitDiffCache(gitClient), logger)
+}
@@ -19,6 +19,7 @@ package pjutil
 import (
 	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -34,28 +35,51 @@ var RetestRe = regexp.MustCompile(`(?m)^/retest\s*$`)
 // RetestRe provides the regex for `/retest-required`
 var RetestRequiredRe = regexp.MustCompile(`(?m)^/retest-required\s*$`)
 
+// TestFailedRe provides the regex for `/test-failed`
+var TestFailedRe = regexp.MustCompile(`(?m)^/test-failed\s*$`)
+
 var OkToTestRe = regexp.MustCompile(`(?m)^/ok-to-test\s*$`)
 
+// TestQueryRe provides the regex for `/test-query <expr>`, where <expr> is
+// parsed by CommentQueryFilter.
+var TestQueryRe = regexp.MustCompile(`(?m)^/test-query\s+(.+)$`)
+
 // AvailablePresubmits returns 3 sets of presubmits:
 // 1. presubmits that can be run with '/test all' command.
 // 2. optional presubmits commands that can be run with their trigger, e.g. '/test job'
 // 3. required presubmits commands that can be run with their trigger, e.g. '/test job'
+//
+// It never recovers from a truncated changes provider; use
+// AvailablePresubmitsWithDiffFallback for that.
 func AvailablePresubmits(changes config.ChangedFilesProvider, org, repo, branch string,
 	presubmits []config.Presubmit, logger *logrus.Entry) (sets.String, sets.String, sets.String, error) {
+	return AvailablePresubmitsWithDiffFallback(changes, org, repo, branch, "", "", presubmits, nil, logger)
+}
+
+// AvailablePresubmitsWithDiffFallback is AvailablePresubmits, plus recovery
+// from a truncated changes provider: base and head identify the diff GitHub
+// may have truncated, and are only used if changes reports
+// ErrChangedFilesTruncated and gitClient is non-nil, in which case the
+// fallback diff is cached for the lifetime of this call so it is only
+// computed once no matter how many presubmits are filtered.
+func AvailablePresubmitsWithDiffFallback(changes config.ChangedFilesProvider, org, repo, branch, base, head string,
+	presubmits []config.Presubmit, gitClient GitClientFactory, logger *logrus.Entry) (sets.String, sets.String, sets.String, error) {
+	defer observeFilterDuration("available-presubmits", time.Now())
 	runWithTestAllNames := sets.NewString()
 	optionalJobTriggerCommands := sets.NewString()
 	requiredJobsTriggerCommands := sets.NewString()
+	cache := NewGitDiffCache(gitClient)
 
-	runWithTestAll, err := FilterPresubmits(TestAllFilter(), changes, branch, presubmits, logger)
+	runWithTestAll, err := FilterPresubmitsWithDiffFallback(TestAllFilter(), changes, org, repo, branch, base, head, presubmits, cache, logger)
 	if err != nil {
 		return runWithTestAllNames, optionalJobTriggerCommands, requiredJobsTriggerCommands, err
 	}
 
-	var triggerFilters []Filter
+	var triggerFilters []NamedFilter
 	for _, ps := range presubmits {
 		triggerFilters = append(triggerFilters, CommandFilter(ps.RerunCommand))
 	}
-	runWithTrigger, err := FilterPresubmits(AggregateFilter(triggerFilters), changes, branch, presubmits, logger)
+	runWithTrigger, err := FilterPresubmitsWithDiffFallback(AggregateFilter(triggerFilters), changes, org, repo, branch, base, head, presubmits, cache, logger)
 	if err != nil {
 		return runWithTestAllNames, optionalJobTriggerCommands, requiredJobsTriggerCommands, err
 	}
@@ -82,55 +106,94 @@ func AvailablePresubmits(changes config.ChangedFilesProvider, org, repo, branch
 //    runs conditionally and does not match trigger conditions
 type Filter func(p config.Presubmit) (shouldRun bool, forcedToRun bool, defaultBehavior bool)
 
+// NamedFilter pairs a Filter with the short identifier of the mechanism that
+// produced it (test-all, retest, retest-required, test-failed, command,
+// command-query, aggregate), so
+// FilterPresubmits and AvailablePresubmits can report which filter made a
+// given decision as a metric label.
+type NamedFilter struct {
+	Filter
+	name string
+}
+
+// Name returns the identifier this filter was constructed with.
+func (nf NamedFilter) Name() string {
+	return nf.name
+}
+
+func namedFilter(name string, f Filter) NamedFilter {
+	return NamedFilter{Filter: f, name: name}
+}
+
 // CommandFilter builds a filter for `/test foo`
-func CommandFilter(body string) Filter {
-	return func(p config.Presubmit) (bool, bool, bool) {
+func CommandFilter(body string) NamedFilter {
+	return namedFilter("command", func(p config.Presubmit) (bool, bool, bool) {
 		return p.TriggerMatches(body), p.TriggerMatches(body), true
-	}
+	})
 }
 
 // TestAllFilter builds a filter for the automatic behavior of `/test all`.
 // Jobs that explicitly match `/test all` in their trigger regex will be
 // handled by a commandFilter for the comment in question.
-func TestAllFilter() Filter {
-	return func(p config.Presubmit) (bool, bool, bool) {
+func TestAllFilter() NamedFilter {
+	return namedFilter("test-all", func(p config.Presubmit) (bool, bool, bool) {
 		return !p.NeedsExplicitTrigger(), false, false
-	}
+	})
 }
 
 // AggregateFilter builds a filter that evaluates the child filters in order
 // and returns the first match
-func AggregateFilter(filters []Filter) Filter {
-	return func(presubmit config.Presubmit) (bool, bool, bool) {
+func AggregateFilter(filters []NamedFilter) NamedFilter {
+	return namedFilter("aggregate", func(presubmit config.Presubmit) (bool, bool, bool) {
 		for _, filter := range filters {
-			if shouldRun, forced, defaults := filter(presubmit); shouldRun {
+			if shouldRun, forced, defaults := filter.Filter(presubmit); shouldRun {
 				return shouldRun, forced, defaults
 			}
 		}
 		return false, false, false
-	}
+	})
 }
 
-// FilterPresubmits determines which presubmits should run by evaluating the user-provided filter.
-func FilterPresubmits(filter Filter, changes config.ChangedFilesProvider, branch string, presubmits []config.Presubmit, logger logrus.FieldLogger) ([]config.Presubmit, error) {
+// FilterPresubmits determines which presubmits should run by evaluating the
+// user-provided filter. org and repo are only used as metric labels; with no
+// GitDiffCache to fall back on, a truncated changes provider's partial list
+// is trusted as-is, same as before truncation detection existed. Use
+// FilterPresubmitsWithDiffFallback to recover the full diff via git instead.
+func FilterPresubmits(filter NamedFilter, changes config.ChangedFilesProvider, org, repo, branch string, presubmits []config.Presubmit, logger logrus.FieldLogger) ([]config.Presubmit, error) {
+	return FilterPresubmitsWithDiffFallback(filter, changes, org, repo, branch, "", "", presubmits, nil, logger)
+}
+
+// FilterPresubmitsWithDiffFallback is FilterPresubmits, plus recovery from a
+// truncated changes provider: base and head identify the diff being
+// evaluated, and are only used if changes reports ErrChangedFilesTruncated
+// and cache is non-nil, in which case cache recomputes and memoizes the full
+// diff via git. A nil cache behaves like FilterPresubmits: the truncated
+// list is trusted as-is.
+func FilterPresubmitsWithDiffFallback(filter NamedFilter, changes config.ChangedFilesProvider, org, repo, branch, base, head string, presubmits []config.Presubmit, cache *GitDiffCache, logger logrus.FieldLogger) ([]config.Presubmit, error) {
+	defer observeFilterDuration(filter.Name(), time.Now())
+	changes = withTruncationFallback(changes, org, repo, base, head, cache, logger)
 
 	var toTrigger []config.Presubmit
 	var namesToTrigger []string
 	var noMatch, shouldnotRun int
 	for _, presubmit := range presubmits {
-		matches, forced, defaults := filter(presubmit)
+		matches, forced, defaults := filter.Filter(presubmit)
 		if !matches {
 			noMatch++
+			recordFilterDecision(filter.Name(), org, repo, branch, decisionNoMatch)
 			continue
 		}
 		shouldRun, err := presubmit.ShouldRun(branch, changes, forced, defaults)
 		if err != nil {
+			recordFilterDecision(filter.Name(), org, repo, branch, decisionError)
 			return nil, fmt.Errorf("%s: should run: %w", presubmit.Name, err)
 		}
 		if !shouldRun {
 			shouldnotRun++
+			recordFilterDecision(filter.Name(), org, repo, branch, decisionShouldNotRun)
 			continue
 		}
+		recordFilterDecision(filter.Name(), org, repo, branch, decisionTriggered)
 		toTrigger = append(toTrigger, presubmit)
 		namesToTrigger = append(namesToTrigger, presubmit.Name)
 	}
@@ -145,47 +208,71 @@ func FilterPresubmits(filter Filter, changes config.ChangedFilesProvider, branch
 }
 
 // RetestFilter builds a filter for `/retest`
-func RetestFilter(failedContexts, allContexts sets.String) Filter {
-	return func(p config.Presubmit) (bool, bool, bool) {
+func RetestFilter(failedContexts, allContexts sets.String) NamedFilter {
+	return namedFilter("retest", func(p config.Presubmit) (bool, bool, bool) {
 		failed := failedContexts.Has(p.Context)
 		return failed || (!p.NeedsExplicitTrigger() && !allContexts.Has(p.Context)), false, failed
-	}
+	})
 }
 
-func RetestRequiredFilter(failedContext, allContexts sets.String) Filter {
-	return func(ps config.Presubmit) (bool, bool, bool) {
+// TestFailedFilter builds a filter for `/test-failed`. Unlike RetestFilter,
+// which also re-runs default-triggered jobs that haven't run yet, it matches
+// strictly the presubmits whose Context is in failedContexts -- a bounded,
+// cheap "retry just what broke" command for large PRs where a full /retest
+// is too much. It is a natural extension point for later variants such as a
+// /test-flaky filter that matches contexts that oscillated pass/fail across
+// recent runs, which would need a new contextGetter-like accessor for
+// context history.
+func TestFailedFilter(failedContexts sets.String) NamedFilter {
+	return namedFilter("test-failed", func(p config.Presubmit) (bool, bool, bool) {
+		failed := failedContexts.Has(p.Context)
+		return failed, true, failed
+	})
+}
+
+func RetestRequiredFilter(failedContext, allContexts sets.String) NamedFilter {
+	return namedFilter("retest-required", func(ps config.Presubmit) (bool, bool, bool) {
 		if ps.Optional {
 			return false, false, false
 		}
-		return RetestFilter(failedContext, allContexts)(ps)
-	}
+		return RetestFilter(failedContext, allContexts).Filter(ps)
+	})
 }
 
 type contextGetter func() (sets.String, sets.String, error)
 
 // PresubmitFilter creates a filter for presubmits
-func PresubmitFilter(honorOkToTest bool, contextGetter contextGetter, body string, logger logrus.FieldLogger) (Filter, error) {
+func PresubmitFilter(honorOkToTest bool, contextGetter contextGetter, body string, logger logrus.FieldLogger) (NamedFilter, error) {
+	defer observeFilterDuration("presubmit-filter", time.Now())
 	// the filters determine if we should check whether a job should run, whether
 	// it should run regardless of whether its triggering conditions match, and
 	// what the default behavior should be for that check. Multiple filters
 	// can match a single presubmit, so it is important to order them correctly
 	// as they have precedence -- filters that override the false default should
 	// match before others. We order filters by amount of specificity.
-	var filters []Filter
+	var filters []NamedFilter
 	filters = append(filters, CommandFilter(body))
 	if RetestRe.MatchString(body) {
 		logger.Info("Using retest filter.")
 		failedContexts, allContexts, err := contextGetter()
 		if err != nil {
-			return nil, err
+			return NamedFilter{}, err
 		}
 		filters = append(filters, RetestFilter(failedContexts, allContexts))
 	}
+	if TestFailedRe.MatchString(body) {
+		logger.Info("Using test-failed filter.")
+		failedContexts, _, err := contextGetter()
+		if err != nil {
+			return NamedFilter{}, err
+		}
+		filters = append(filters, TestFailedFilter(failedContexts))
+	}
 	if RetestRequiredRe.MatchString(body) {
 		logger.Info("Using retest-required filter")
 		failedContexts, allContexts, err := contextGetter()
 		if err != nil {
-			return nil, err
+			return NamedFilter{}, err
 		}
 		filters = append(filters, RetestRequiredFilter(failedContexts, allContexts))
 	}
@@ -193,5 +280,13 @@ func PresubmitFilter(honorOkToTest bool, contextGetter contextGetter, body strin
 		logger.Debug("Using test-all filter.")
 		filters = append(filters, TestAllFilter())
 	}
+	if match := TestQueryRe.FindStringSubmatch(body); match != nil {
+		logger.Debug("Using command-query filter.")
+		queryFilter, err := CommentQueryFilter(match[1])
+		if err != nil {
+			return NamedFilter{}, err
+		}
+		filters = append(filters, queryFilter)
+	}
 	return AggregateFilter(filters), nil
 }
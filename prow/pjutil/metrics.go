@@ -0,0 +1,57 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pjutil
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	decisionTriggered    = "triggered"
+	decisionNoMatch      = "no_match"
+	decisionShouldNotRun = "should_not_run"
+	decisionError        = "error"
+)
+
+var (
+	filterDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pjutil_filter_decisions_total",
+		Help: "Count of per-job (presubmit or deployment) filter decisions, labeled by which filter made the decision and the outcome (triggered, no_match, should_not_run, error).",
+	}, []string{"filter", "org", "repo", "branch", "decision"})
+
+	filterDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "pjutil_filter_duration_seconds",
+		Help: "Time spent evaluating a filter, e.g. FilterPresubmits for a single NamedFilter or AvailablePresubmits for a whole batch.",
+	}, []string{"filter"})
+)
+
+// Register registers the pjutil filter metrics with registry. hook and any
+// other binary that wants "why didn't my job trigger" visibility must call
+// this once during startup before the metrics are scraped.
+func Register(registry prometheus.Registerer) {
+	registry.MustRegister(filterDecisions, filterDuration)
+}
+
+func recordFilterDecision(filter, org, repo, branch, decision string) {
+	filterDecisions.WithLabelValues(filter, org, repo, branch, decision).Inc()
+}
+
+func observeFilterDuration(filter string, start time.Time) {
+	filterDuration.WithLabelValues(filter).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pjutil
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+// queryFields are the config.Presubmit attributes a CommentQueryFilter
+// clause may target.
+var queryFields = map[string]bool{
+	"job":        true,
+	"label":      true,
+	"annotation": true,
+	"command":    true,
+	"context":    true,
+	"branch":     true,
+}
+
+// queryUsage is repeated in every CommentQueryFilter parse error so that a
+// user who pastes something like `/test job:e2e-* label:area/networking
+// env:staging` (space-separated, no operator, and an env field that doesn't
+// exist for presubmits) gets pointed at the actual grammar instead of just
+// "malformed query clause".
+const queryUsage = `expected clauses of the form "field:op:value" joined by ';', e.g. /test-query job:matches:e2e-.*;label:eq:area/networking;branch:in:main,release-1.0 -- valid fields are job, label, annotation, command, context, branch; valid ops are eq, ne, matches, in; there is no env field (deployment environment matching is done by DeploymentFilter, not CommentQueryFilter)`
+
+type queryOp string
+
+const (
+	queryOpEq      queryOp = "eq"
+	queryOpNe      queryOp = "ne"
+	queryOpMatches queryOp = "matches"
+	queryOpIn      queryOp = "in"
+)
+
+// queryPredicate is a single parsed `field:op:value` clause. Compilation
+// work that can fail (parsing a regexp, say) happens once up front in
+// parseQueryClause so that evaluating a predicate against a presubmit can
+// never itself error.
+type queryPredicate struct {
+	field   string
+	op      queryOp
+	value   string
+	values  []string
+	pattern *regexp.Regexp
+}
+
+func parseQueryClause(clause string) (queryPredicate, error) {
+	parts := strings.SplitN(clause, ":", 3)
+	if len(parts) != 3 {
+		return queryPredicate{}, fmt.Errorf("malformed query clause %q: %s", clause, queryUsage)
+	}
+	field, op, value := parts[0], queryOp(parts[1]), strings.Trim(parts[2], `"`)
+	if !queryFields[field] {
+		return queryPredicate{}, fmt.Errorf("unknown query field %q in clause %q: %s", field, clause, queryUsage)
+	}
+
+	predicate := queryPredicate{field: field, op: op, value: value}
+	switch op {
+	case queryOpEq, queryOpNe:
+		// value is compared as-is, nothing to precompute.
+	case queryOpMatches:
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return queryPredicate{}, fmt.Errorf("invalid regexp %q in clause %q: %w", value, clause, err)
+		}
+		predicate.pattern = pattern
+	case queryOpIn:
+		predicate.values = strings.Split(value, ",")
+	default:
+		return queryPredicate{}, fmt.Errorf("unknown query operator %q in clause %q: %s", op, clause, queryUsage)
+	}
+	return predicate, nil
+}
+
+// splitQueryClauses splits a CommentQueryFilter query on ';' (AND), treating
+// any text inside double quotes as literal so a value can itself contain ';'
+// or surrounding whitespace.
+func splitQueryClauses(query string) ([]string, error) {
+	var clauses []string
+	var current strings.Builder
+	inQuotes := false
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '"':
+			// Keep the quote so surrounding whitespace inside it survives
+			// the TrimSpace below; parseQueryClause strips it from the value.
+			inQuotes = !inQuotes
+			current.WriteByte(c)
+		case c == ';' && !inQuotes:
+			clauses = append(clauses, strings.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in query %q", query)
+	}
+	if trimmed := strings.TrimSpace(current.String()); trimmed != "" {
+		clauses = append(clauses, trimmed)
+	}
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("empty query: %s", queryUsage)
+	}
+	return clauses, nil
+}
+
+func mapToStrings(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k, v := range m {
+		if v == "" {
+			out = append(out, k)
+		} else {
+			out = append(out, k+"="+v)
+		}
+	}
+	return out
+}
+
+func (q queryPredicate) matchesAny(values []string) bool {
+	switch q.op {
+	case queryOpEq:
+		for _, v := range values {
+			if v == q.value {
+				return true
+			}
+		}
+		return false
+	case queryOpNe:
+		for _, v := range values {
+			if v == q.value {
+				return false
+			}
+		}
+		return true
+	case queryOpMatches:
+		for _, v := range values {
+			if q.pattern.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	case queryOpIn:
+		for _, v := range values {
+			for _, want := range q.values {
+				if v == want {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func (q queryPredicate) matches(p config.Presubmit) bool {
+	switch q.field {
+	case "job":
+		return q.matchesAny([]string{p.Name})
+	case "command":
+		return q.matchesAny([]string{p.RerunCommand})
+	case "context":
+		return q.matchesAny([]string{p.Context})
+	case "branch":
+		return q.matchesAny(p.Branches)
+	case "label":
+		return q.matchesAny(mapToStrings(p.Labels))
+	case "annotation":
+		return q.matchesAny(mapToStrings(p.Annotations))
+	}
+	return false
+}
+
+// CommentQueryFilter parses query into a filter that ANDs each clause
+// against a config.Presubmit. Clauses look like `field:op:value`, joined by
+// ';' for AND, e.g.:
+//
+//	job:matches:e2e-.*;label:eq:area/networking;branch:in:main,release-1.0
+//
+// Note this is NOT the same as the shorthand `job:e2e-* label:area/networking`
+// form one might guess at by analogy with other comment DSLs: every clause
+// needs an explicit op (eq, ne, matches or in), clauses are joined by ';'
+// rather than whitespace, and there is no env field (that's
+// deployment-specific and handled by DeploymentFilter instead).
+//
+// Supported fields are job (Name), label (Labels), annotation
+// (Annotations), command (RerunCommand), context (Context) and branch
+// (Branches). Supported operators are eq, ne, matches (value is a regexp)
+// and in (value is a comma-separated list). Values may be double-quoted to
+// include a literal ';' or surrounding whitespace. Parse errors repeat this
+// grammar (see queryUsage) so hook can echo something actionable back as a
+// PR comment, and the predicate parsing here is intentionally independent
+// of config.Presubmit's ShouldRun/trigger machinery so postsubmit and
+// periodic selection can reuse it against their own field sets.
+func CommentQueryFilter(query string) (NamedFilter, error) {
+	clauses, err := splitQueryClauses(query)
+	if err != nil {
+		return NamedFilter{}, fmt.Errorf("invalid /test-query expression %q: %w", query, err)
+	}
+
+	predicates := make([]queryPredicate, 0, len(clauses))
+	for _, clause := range clauses {
+		predicate, err := parseQueryClause(clause)
+		if err != nil {
+			return NamedFilter{}, fmt.Errorf("invalid /test-query expression %q: %w", query, err)
+		}
+		predicates = append(predicates, predicate)
+	}
+
+	return namedFilter("command-query", func(p config.Presubmit) (bool, bool, bool) {
+		for _, predicate := range predicates {
+			if !predicate.matches(p) {
+				return false, false, false
+			}
+		}
+		return true, true, true
+	}), nil
+}